@@ -0,0 +1,251 @@
+// Copyright (C) 2018 go-nebulas authors
+//
+// This file is part of the go-nebulas library.
+//
+// the go-nebulas library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// the go-nebulas library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with the go-nebulas library.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package sync
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/nebulasio/go-nebulas/core"
+	"github.com/nebulasio/go-nebulas/core/pb"
+	"github.com/nebulasio/go-nebulas/net"
+	"github.com/nebulasio/go-nebulas/net/p2p"
+	"github.com/nebulasio/go-nebulas/sync/pb"
+	"github.com/nebulasio/go-nebulas/util/logging"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	ErrChunkStreamBrokenParentLink = errors.New("chunk stream block does not link to previous block")
+)
+
+// ChunkDataIterator streams the blocks of a single chunk one at a time over
+// a ChainChunkDataStream, instead of requiring the whole chunk (up to
+// core.ChunkSize blocks) to be buffered in memory before it can be verified
+// and applied. Memory use drops from O(ChunkSize*blockSize) per in-flight
+// chunk to O(1).
+type ChunkDataIterator struct {
+	stream      p2p.Stream
+	chunkHeader *syncpb.ChunkHeader
+	prevHash    []byte
+	done        bool
+
+	// bytesRead is the total size of the raw framed messages consumed so
+	// far, so the scheduler can score the serving peer's throughput the
+	// same way the buffered fetch path does.
+	bytesRead int
+}
+
+// NewChunkDataIterator wraps stream so its framed blocks can be consumed one
+// at a time, each linked to parentHash (the hash of the last applied
+// block).
+func NewChunkDataIterator(stream p2p.Stream, chunkHeader *syncpb.ChunkHeader, parentHash []byte) *ChunkDataIterator {
+	return &ChunkDataIterator{
+		stream:      stream,
+		chunkHeader: chunkHeader,
+		prevHash:    parentHash,
+	}
+}
+
+// Next returns the next block in the stream, verifying its parent link
+// against the previously returned block, and returns io.EOF once the
+// terminal block (matching chunkHeader.Root) has been returned.
+func (it *ChunkDataIterator) Next() (*core.Block, error) {
+	if it.done {
+		return nil, io.EOF
+	}
+
+	message, err := it.stream.Recv()
+	if err == io.EOF {
+		// the stream ended before the terminal block arrived.
+		return nil, io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	raw := message.Data().([]byte)
+	it.bytesRead += len(raw)
+
+	block, err := blockFromStreamedBytes(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	if bytes.Compare(block.ParentHash(), it.prevHash) != 0 {
+		return nil, ErrChunkStreamBrokenParentLink
+	}
+	it.prevHash = block.Hash()
+
+	if bytes.Compare(block.Hash(), it.chunkHeader.Root) == 0 {
+		it.done = true
+	}
+
+	return block, nil
+}
+
+// Close releases the underlying stream.
+func (it *ChunkDataIterator) Close() error {
+	return it.stream.Close()
+}
+
+// BytesRead returns the total size of the raw framed messages consumed so
+// far.
+func (it *ChunkDataIterator) BytesRead() int {
+	return it.bytesRead
+}
+
+func blockFromStreamedBytes(raw []byte) (*core.Block, error) {
+	pbBlock := new(corepb.Block)
+	if err := proto.Unmarshal(raw, pbBlock); err != nil {
+		return nil, err
+	}
+
+	block := new(core.Block)
+	if err := block.FromProto(pbBlock); err != nil {
+		return nil, err
+	}
+	return block, nil
+}
+
+// sendChainGetChunkMessageStream opens a ChainChunkDataStream with peer
+// instead of sending a single request/response ChainGetChunk message, and
+// processes the resulting blocks as they arrive via processChunkStream.
+func (st *SyncTask) sendChainGetChunkMessageStream(chunkHeaderIndex int, peer string) {
+	chunkHeader := st.maxConsistentChunkHeaders.ChunkHeaders[chunkHeaderIndex]
+	data, err := proto.Marshal(chunkHeader)
+	if err != nil {
+		logging.VLog().WithFields(logrus.Fields{
+			"err": err,
+		}).Warn("Failed to marshal ChunkHeader.")
+		return
+	}
+
+	stream, err := st.netService.OpenStream(net.ChainChunkDataStream, data, peer)
+	if err != nil {
+		logging.VLog().WithFields(logrus.Fields{
+			"err":  err,
+			"peer": peer,
+		}).Debug("Failed to open ChainChunkDataStream, retrying with another peer.")
+		st.sendChainGetChunkMessageExcluding(chunkHeaderIndex, map[string]bool{peer: true})
+		return
+	}
+
+	st.scheduler.assign(chunkHeaderIndex, peer)
+	st.chainChunkDataStatus[chunkHeaderIndex] = time.Now().Unix()
+
+	parentHash := st.syncPointBlock.Hash()
+	if chunkHeaderIndex > 0 {
+		parentHash = st.maxConsistentChunkHeaders.ChunkHeaders[chunkHeaderIndex-1].Root
+	}
+
+	iter := NewChunkDataIterator(stream, chunkHeader, parentHash)
+	go st.processChunkStream(iter, chunkHeaderIndex, peer)
+}
+
+// processChunkStream consumes iter block by block, holding each received
+// block until chunkDataIndex is the next chunk due for application (and, if
+// it is also the irreversible-block sync ceiling, until a supermajority of
+// respondents agree on the irreversible height - see
+// chunkPassesIrreversibleGate) - the scheduler dispatches several
+// non-adjacent chunk indices concurrently, so without the ordering half of
+// this gate whichever chunk's peer answers first would be applied out of
+// order, and chainChunkDataProcessPosition could regress or skip ahead of
+// chunks that haven't even started - and marks the chunk finished once the
+// iterator is exhausted.
+func (st *SyncTask) processChunkStream(iter *ChunkDataIterator, chunkDataIndex int, peer string) {
+	defer iter.Close()
+
+	for {
+		block, err := iter.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			logging.VLog().WithFields(logrus.Fields{
+				"err":  err,
+				"peer": peer,
+			}).Debug("Chunk stream failed, retry.")
+			st.netService.ClosePeer(peer, err)
+
+			st.syncMutex.Lock()
+			failedPeer := st.scheduler.reassign(chunkDataIndex)
+			st.scheduler.recordFailure(peer)
+			excludePeers := map[string]bool{peer: true}
+			if failedPeer != "" {
+				excludePeers[failedPeer] = true
+			}
+			st.sendChainGetChunkMessageExcluding(chunkDataIndex, excludePeers)
+			st.syncMutex.Unlock()
+			return
+		}
+
+		st.waitForChunkTurn(chunkDataIndex)
+
+		st.syncMutex.Lock()
+		if err := st.blockChain.PutVerifiedBlock(block); err != nil {
+			logging.VLog().WithFields(logrus.Fields{
+				"err":  err,
+				"peer": peer,
+			}).Debug("Failed to apply streamed block, retry.")
+			st.netService.ClosePeer(peer, err)
+			st.sendChainGetChunkMessage(chunkDataIndex)
+			st.syncMutex.Unlock()
+			return
+		}
+		st.syncMutex.Unlock()
+	}
+
+	st.syncMutex.Lock()
+	dispatchedAt := st.chainChunkDataStatus[chunkDataIndex]
+	st.scheduler.recordSuccess(peer, time.Duration(time.Now().Unix()-dispatchedAt)*time.Second, iter.BytesRead())
+	st.scheduler.release(chunkDataIndex)
+	st.chainChunkDataStatus[chunkDataIndex] = chunkDataStatusFinished
+	st.chainChunkDataProcessPosition = chunkDataIndex + 1
+	st.syncMutex.Unlock()
+
+	st.sendChainGetChunkForNext()
+}
+
+// chunkTurnPollInterval is how often waitForChunkTurn rechecks whether a
+// streamed chunk has become the next one due for application.
+const chunkTurnPollInterval = 50 * time.Millisecond
+
+// waitForChunkTurn blocks until chunkDataIndex is
+// chainChunkDataProcessPosition and chunkPassesIrreversibleGate(chunkDataIndex)
+// holds, so a block streamed for a chunk that is ahead of the current apply
+// position is held (at most one block at a time, preserving the O(1) memory
+// use the streaming path exists for) instead of being applied before
+// earlier chunks are done, and the final chunk is held until a
+// supermajority of respondents agree on the irreversible height - the same
+// gate applyReadyChunks enforces for the buffered fetch path.
+func (st *SyncTask) waitForChunkTurn(chunkDataIndex int) {
+	for {
+		st.syncMutex.Lock()
+		ready := st.chainChunkDataProcessPosition == chunkDataIndex && st.chunkPassesIrreversibleGate(chunkDataIndex)
+		st.syncMutex.Unlock()
+		if ready {
+			return
+		}
+		time.Sleep(chunkTurnPollInterval)
+	}
+}
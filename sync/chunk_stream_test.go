@@ -0,0 +1,95 @@
+// Copyright (C) 2018 go-nebulas authors
+//
+// This file is part of the go-nebulas library.
+//
+// the go-nebulas library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// the go-nebulas library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with the go-nebulas library.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package sync
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nebulasio/go-nebulas/sync/pb"
+)
+
+func TestWaitForChunkTurnBlocksUntilItsPosition(t *testing.T) {
+	st := &SyncTask{
+		chainChunkDataProcessPosition: 0,
+		// more than one chunk header, so index 2 is not the irreversible
+		// sync ceiling and chunkPassesIrreversibleGate is a no-op here -
+		// this test is only about the position half of the gate.
+		maxConsistentChunkHeaders: &syncpb.ChunkHeaders{
+			ChunkHeaders: []*syncpb.ChunkHeader{{Height: 1}, {Height: 2}, {Height: 3}, {Height: 4}},
+		},
+	}
+
+	unblocked := make(chan struct{})
+	go func() {
+		st.waitForChunkTurn(2)
+		close(unblocked)
+	}()
+
+	select {
+	case <-unblocked:
+		t.Fatalf("waitForChunkTurn(2) returned before chainChunkDataProcessPosition reached 2")
+	case <-time.After(3 * chunkTurnPollInterval):
+	}
+
+	st.syncMutex.Lock()
+	st.chainChunkDataProcessPosition = 2
+	st.syncMutex.Unlock()
+
+	select {
+	case <-unblocked:
+	case <-time.After(time.Second):
+		t.Fatalf("waitForChunkTurn(2) did not return after chainChunkDataProcessPosition reached 2")
+	}
+}
+
+func TestWaitForChunkTurnHoldsFinalChunkUntilSupermajority(t *testing.T) {
+	st := &SyncTask{
+		chainChunkDataProcessPosition: 0,
+		// a single chunk header: index 0 is both the current position and
+		// the irreversible sync ceiling.
+		maxConsistentChunkHeaders: &syncpb.ChunkHeaders{ChunkHeaders: []*syncpb.ChunkHeader{{Height: 1}}},
+		receivedChunkHeadersRootHashPeers: map[string]bool{
+			"root-a-p1": true, "root-b-p2": true, "root-b-p3": true,
+		},
+		irreversibleHeightVotes: map[uint64]int{0: 1},
+	}
+
+	unblocked := make(chan struct{})
+	go func() {
+		st.waitForChunkTurn(0)
+		close(unblocked)
+	}()
+
+	select {
+	case <-unblocked:
+		t.Fatalf("waitForChunkTurn(0) returned before a supermajority agreed on the irreversible height, even though it was already the current position")
+	case <-time.After(3 * chunkTurnPollInterval):
+	}
+
+	st.syncMutex.Lock()
+	st.irreversibleHeightVotes[0] = 2
+	st.syncMutex.Unlock()
+
+	select {
+	case <-unblocked:
+	case <-time.After(time.Second):
+		t.Fatalf("waitForChunkTurn(0) did not return once a supermajority agreed on the irreversible height")
+	}
+}
@@ -0,0 +1,126 @@
+// Copyright (C) 2018 go-nebulas authors
+//
+// This file is part of the go-nebulas library.
+//
+// the go-nebulas library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// the go-nebulas library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with the go-nebulas library.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package sync
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/nebulasio/go-nebulas/sync/pb"
+)
+
+func chainedHeaders(parent []byte, hashes ...string) *syncpb.Headers {
+	headers := &syncpb.Headers{}
+	prev := parent
+	for _, h := range hashes {
+		headers.Headers = append(headers.Headers, &syncpb.Header{Hash: []byte(h), ParentHash: prev})
+		prev = []byte(h)
+	}
+	return headers
+}
+
+func TestStoreHeaderRange(t *testing.T) {
+	r := fetchRange{from: 128, to: 132}
+	headers := chainedHeaders([]byte("h128"), "h129", "h130", "h131", "h132")
+
+	headerChain := make(map[uint64][]byte)
+	storeHeaderRange(headerChain, r, headers)
+
+	if _, ok := headerChain[r.from]; ok {
+		t.Fatalf("storeHeaderRange must not overwrite the skeleton anchor at r.from=%d, GetHeaders is exclusive of it", r.from)
+	}
+
+	want := map[uint64]string{129: "h129", 130: "h130", 131: "h131", 132: "h132"}
+	for height, wantHash := range want {
+		got, ok := headerChain[height]
+		if !ok {
+			t.Fatalf("expected header at height %d to be stored", height)
+		}
+		if !bytes.Equal(got, []byte(wantHash)) {
+			t.Fatalf("height %d: got %q, want %q", height, got, wantHash)
+		}
+	}
+
+	if got, ok := headerChain[r.to]; !ok || !bytes.Equal(got, []byte("h132")) {
+		t.Fatalf("expected the anchor at r.to=%d to be stored, got %q ok=%v", r.to, got, ok)
+	}
+}
+
+func fastSyncTaskWithSkeleton(from, to uint64, fromHash, toHash []byte) *FastSyncTask {
+	return &FastSyncTask{
+		skeletonList: []*syncpb.SkeletonHeader{
+			{Height: from, Hash: fromHash},
+			{Height: to, Hash: toHash},
+		},
+	}
+}
+
+func TestVerifyHeaderRangeAcceptsAnActualChain(t *testing.T) {
+	fst := fastSyncTaskWithSkeleton(128, 132, []byte("h128"), []byte("h132"))
+	r := fetchRange{from: 128, to: 132}
+	headers := chainedHeaders([]byte("h128"), "h129", "h130", "h131", "h132")
+
+	ok, err := fst.verifyHeaderRange(r, headers)
+	if !ok {
+		t.Fatalf("verifyHeaderRange() ok = false, err = %v, want a valid chain accepted", err)
+	}
+}
+
+func TestVerifyHeaderRangeRejectsWrongLength(t *testing.T) {
+	fst := fastSyncTaskWithSkeleton(128, 132, []byte("h128"), []byte("h132"))
+	r := fetchRange{from: 128, to: 132}
+	// one entry short of the requested span.
+	headers := chainedHeaders([]byte("h128"), "h129", "h130", "h132")
+
+	if ok, err := fst.verifyHeaderRange(r, headers); ok || err != ErrHeaderRangeLengthMismatch {
+		t.Fatalf("verifyHeaderRange() = (%v, %v), want (false, ErrHeaderRangeLengthMismatch)", ok, err)
+	}
+}
+
+func TestVerifyHeaderRangeRejectsBrokenInteriorChain(t *testing.T) {
+	fst := fastSyncTaskWithSkeleton(128, 132, []byte("h128"), []byte("h132"))
+	r := fetchRange{from: 128, to: 132}
+	headers := &syncpb.Headers{Headers: []*syncpb.Header{
+		{Hash: []byte("h129"), ParentHash: []byte("h128")},
+		// garbage interior entry: does not link to h129, but the range has
+		// the requested length and the last entry still matches the r.to
+		// anchor, so only checking endpoints (as the old implementation
+		// did) would wrongly accept this.
+		{Hash: []byte("h130"), ParentHash: []byte("not-h129")},
+		{Hash: []byte("h131"), ParentHash: []byte("h130")},
+		{Hash: []byte("h132"), ParentHash: []byte("h131")},
+	}}
+
+	if ok, err := fst.verifyHeaderRange(r, headers); ok || err != ErrHeaderChainBroken {
+		t.Fatalf("verifyHeaderRange() = (%v, %v), want (false, ErrHeaderChainBroken)", ok, err)
+	}
+}
+
+func TestFetchQueueEmptyWhenNoGapsDispatched(t *testing.T) {
+	fst := NewFastSyncTask(nil, nil, nil, nil)
+	// a single-anchor (or empty) skeleton means the trusted peer is
+	// already within one interval of our tip: dispatchFetchQueue's loop
+	// never runs, so the queue starts out empty.
+	fst.skeletonList = []*syncpb.SkeletonHeader{{Height: 100, Hash: []byte("h100")}}
+	fst.dispatchFetchQueue()
+
+	if !fst.fetchQueueEmpty() {
+		t.Fatalf("expected fetchQueueEmpty() to be true when the skeleton has fewer than 2 anchors")
+	}
+}
@@ -0,0 +1,195 @@
+// Copyright (C) 2018 go-nebulas authors
+//
+// This file is part of the go-nebulas library.
+//
+// the go-nebulas library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// the go-nebulas library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with the go-nebulas library.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package sync
+
+import (
+	"sync"
+	"time"
+)
+
+// PeerPerChunkBudget caps how many chunk requests may be in flight at the
+// same time for a single peer.
+const PeerPerChunkBudget = 2
+
+// PeerBlacklistFailureThreshold is the number of consecutive failures
+// (timeouts or VerifyChunkData rejections) after which a peer is
+// temporarily excluded from chunk selection.
+const PeerBlacklistFailureThreshold = 3
+
+// PeerBlacklistDuration is how long a blacklisted peer is kept out of
+// selection before it is given another chance.
+const PeerBlacklistDuration = 2 * time.Minute
+
+// peerStats tracks the recent performance of a single peer serving chunk
+// data, used to score it relative to its competitors.
+type peerStats struct {
+	// sampled is set once recordSuccess has run at least once for this
+	// peer. latency's zero value is indistinguishable from "a peer that
+	// answered instantly" (and even a real sub-second recordSuccess
+	// currently rounds down to 0), so it cannot be used on its own to
+	// tell "never tried" apart from "fastest peer we have".
+	sampled        bool
+	latency        time.Duration
+	bytesServed    uint64
+	failureCount   int
+	blacklistUntil int64
+}
+
+func (s *peerStats) isBlacklisted() bool {
+	return s.blacklistUntil > 0 && time.Now().Unix() < s.blacklistUntil
+}
+
+// chunkScheduler keeps a per-peer in-flight budget and tracks per-peer
+// performance so that distinct chunk indices can be dispatched to distinct
+// peers concurrently, and so that timeouts or bad data trigger a targeted
+// resend to the next-best peer rather than another random broadcast.
+type chunkScheduler struct {
+	mu sync.Mutex
+
+	// pendingRequests is the number of chunks currently in flight per peer.
+	pendingRequests map[string]int
+	// assignedTo is the peer currently servicing a given chunk index.
+	assignedTo map[int]string
+	// stats is keyed by peer ID.
+	stats map[string]*peerStats
+}
+
+func newChunkScheduler() *chunkScheduler {
+	return &chunkScheduler{
+		pendingRequests: make(map[string]int),
+		assignedTo:      make(map[int]string),
+		stats:           make(map[string]*peerStats),
+	}
+}
+
+func (s *chunkScheduler) statsFor(peer string) *peerStats {
+	st, ok := s.stats[peer]
+	if !ok {
+		st = &peerStats{}
+		s.stats[peer] = st
+	}
+	return st
+}
+
+// pickPeer picks the best-scoring, non-blacklisted, under-budget candidate
+// for a chunk, preferring measured peers with lower latency. Failure count
+// only matters through the blacklist; it does not otherwise rank peers.
+// excludePeers lets reassign() avoid immediately re-picking the peer that
+// just failed.
+func (s *chunkScheduler) pickPeer(candidates []string, excludePeers map[string]bool) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	best := ""
+	var bestScore time.Duration
+	bestSampled := false
+
+	for _, peer := range candidates {
+		if excludePeers[peer] {
+			continue
+		}
+		st := s.statsFor(peer)
+		if st.isBlacklisted() {
+			continue
+		}
+		if s.pendingRequests[peer] >= PeerPerChunkBudget {
+			continue
+		}
+
+		if best == "" {
+			best, bestScore, bestSampled = peer, st.latency, st.sampled
+			continue
+		}
+		// a peer with measured latency always beats an untested one, and
+		// beats another measured peer only by being faster; an untested
+		// peer's zero-value latency must never look "faster" than a real
+		// measurement.
+		if st.sampled && (!bestSampled || st.latency < bestScore) {
+			best, bestScore, bestSampled = peer, st.latency, st.sampled
+		}
+	}
+
+	return best
+}
+
+// assign records that chunkIdx has been dispatched to peer.
+func (s *chunkScheduler) assign(chunkIdx int, peer string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.assignedTo[chunkIdx] = peer
+	s.pendingRequests[peer]++
+}
+
+// release drops the in-flight bookkeeping for a chunk, e.g. once it has
+// finished or is being reassigned to another peer.
+func (s *chunkScheduler) release(chunkIdx int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	peer, ok := s.assignedTo[chunkIdx]
+	if !ok {
+		return
+	}
+	if s.pendingRequests[peer] > 0 {
+		s.pendingRequests[peer]--
+	}
+	delete(s.assignedTo, chunkIdx)
+}
+
+// recordSuccess updates a peer's score after it has successfully served a
+// chunk.
+func (s *chunkScheduler) recordSuccess(peer string, latency time.Duration, bytesServed int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st := s.statsFor(peer)
+	st.sampled = true
+	st.latency = latency
+	st.bytesServed += uint64(bytesServed)
+	st.failureCount = 0
+}
+
+// recordFailure penalizes a peer after a timeout or a VerifyChunkData
+// rejection, temporarily blacklisting it once it crosses the failure
+// threshold.
+func (s *chunkScheduler) recordFailure(peer string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st := s.statsFor(peer)
+	st.failureCount++
+	if st.failureCount >= PeerBlacklistFailureThreshold {
+		st.blacklistUntil = time.Now().Add(PeerBlacklistDuration).Unix()
+	}
+}
+
+// reassign drops chunkIdx's current assignment and returns the excluded
+// peer so the caller can pick the next-best candidate for it.
+func (s *chunkScheduler) reassign(chunkIdx int) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	peer := s.assignedTo[chunkIdx]
+	delete(s.assignedTo, chunkIdx)
+	if peer != "" && s.pendingRequests[peer] > 0 {
+		s.pendingRequests[peer]--
+	}
+	return peer
+}
@@ -0,0 +1,58 @@
+// Copyright (C) 2018 go-nebulas authors
+//
+// This file is part of the go-nebulas library.
+//
+// the go-nebulas library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// the go-nebulas library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with the go-nebulas library.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package sync
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPickPeerPrefersMeasuredOverUntested(t *testing.T) {
+	s := newChunkScheduler()
+
+	// "fast" has a real, measured latency; "untested" has never been
+	// recorded and so still carries the zero-value latency.
+	s.recordSuccess("fast", 50*time.Millisecond, 1024)
+
+	got := s.pickPeer([]string{"untested", "fast"}, nil)
+	if got != "fast" {
+		t.Fatalf("pickPeer() = %q, want %q (measured peer must beat an untested one)", got, "fast")
+	}
+}
+
+func TestPickPeerPicksFasterOfTwoMeasuredPeers(t *testing.T) {
+	s := newChunkScheduler()
+
+	s.recordSuccess("slow", 500*time.Millisecond, 1024)
+	s.recordSuccess("fast", 50*time.Millisecond, 1024)
+
+	got := s.pickPeer([]string{"slow", "fast"}, nil)
+	if got != "fast" {
+		t.Fatalf("pickPeer() = %q, want %q", got, "fast")
+	}
+}
+
+func TestPickPeerFallsBackToUntestedIfNoneMeasured(t *testing.T) {
+	s := newChunkScheduler()
+
+	got := s.pickPeer([]string{"a", "b"}, nil)
+	if got != "a" && got != "b" {
+		t.Fatalf("pickPeer() = %q, want one of the untested candidates", got)
+	}
+}
@@ -0,0 +1,158 @@
+// Copyright (C) 2018 go-nebulas authors
+//
+// This file is part of the go-nebulas library.
+//
+// the go-nebulas library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// the go-nebulas library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with the go-nebulas library.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package sync
+
+import (
+	"encoding/binary"
+	"sync"
+
+	lru "github.com/hashicorp/golang-lru"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/nebulasio/go-nebulas/storage"
+	"github.com/nebulasio/go-nebulas/sync/pb"
+)
+
+// chunkStoreNamespace prefixes every key this subsystem writes, so it can
+// share a LevelDB instance with the rest of the node without colliding.
+const chunkStoreNamespace = "sync_chunk_"
+
+// rootListKey stores the agreed maxConsistentChunkHeaders so a restarted
+// node knows which chunks it was downloading without re-running ChainSync.
+var rootListKey = []byte(chunkStoreNamespace + "root_list")
+
+// chunkStoreLRUSize bounds how many not-yet-applied chunks are kept staged
+// on disk at once, so a reset() triggered by a changing peer set cannot
+// grow the staging area without limit.
+const chunkStoreLRUSize = 2 * ConcurrentSyncChunkDataCount
+
+// ChunkStagingStore persists downloaded but not-yet-applied chunk data (and
+// the agreed root header list) to disk, so a crashed or restarted sync can
+// resume from where it left off instead of starting over from
+// blockChain.TailBlock().
+type ChunkStagingStore struct {
+	mu  sync.Mutex
+	db  storage.Storage
+	lru *lru.Cache
+}
+
+// NewChunkStagingStore wraps db with the chunk-staging key namespace.
+func NewChunkStagingStore(db storage.Storage) (*ChunkStagingStore, error) {
+	cache, err := lru.New(chunkStoreLRUSize)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ChunkStagingStore{
+		db:  db,
+		lru: cache,
+	}, nil
+}
+
+func chunkDataKey(chunkIndex int) []byte {
+	key := make([]byte, len(chunkStoreNamespace)+8)
+	copy(key, chunkStoreNamespace)
+	binary.BigEndian.PutUint64(key[len(chunkStoreNamespace):], uint64(chunkIndex))
+	return key
+}
+
+// PutChunkData persists a verified chunk before the caller advances
+// chainChunkDataProcessPosition, evicting the least-recently-staged chunk
+// if the bounded LRU is full.
+func (s *ChunkStagingStore) PutChunkData(chunkIndex int, data *syncpb.ChunkData) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	raw, err := proto.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	if err := s.db.Put(chunkDataKey(chunkIndex), raw); err != nil {
+		return err
+	}
+
+	if !s.lru.Contains(chunkIndex) && s.lru.Len() >= chunkStoreLRUSize {
+		if evicted, _, ok := s.lru.RemoveOldest(); ok {
+			s.db.Del(chunkDataKey(evicted.(int)))
+		}
+	}
+	s.lru.Add(chunkIndex, true)
+
+	return nil
+}
+
+// GetChunkData loads a previously staged chunk, if any.
+func (s *ChunkStagingStore) GetChunkData(chunkIndex int) (*syncpb.ChunkData, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	raw, err := s.db.Get(chunkDataKey(chunkIndex))
+	if err != nil {
+		return nil, err
+	}
+
+	data := new(syncpb.ChunkData)
+	if err := proto.Unmarshal(raw, data); err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+// DeleteChunkData compacts away a chunk once it has been successfully
+// applied by st.chunk.processChunkData.
+func (s *ChunkStagingStore) DeleteChunkData(chunkIndex int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lru.Remove(chunkIndex)
+	return s.db.Del(chunkDataKey(chunkIndex))
+}
+
+// PutRootList persists the agreed maxConsistentChunkHeaders.
+func (s *ChunkStagingStore) PutRootList(headers *syncpb.ChunkHeaders) error {
+	raw, err := proto.Marshal(headers)
+	if err != nil {
+		return err
+	}
+	return s.db.Put(rootListKey, raw)
+}
+
+// GetRootList loads the root list persisted by a previous run, returning
+// (nil, nil) if none was staged.
+func (s *ChunkStagingStore) GetRootList() (*syncpb.ChunkHeaders, error) {
+	raw, err := s.db.Get(rootListKey)
+	if err != nil {
+		return nil, nil
+	}
+
+	headers := new(syncpb.ChunkHeaders)
+	if err := proto.Unmarshal(raw, headers); err != nil {
+		return nil, err
+	}
+
+	return headers, nil
+}
+
+// DeleteRootList clears the staged root list, called once a sync round
+// finishes cleanly so the next round starts from a fresh tail.
+func (s *ChunkStagingStore) DeleteRootList() error {
+	return s.db.Del(rootListKey)
+}
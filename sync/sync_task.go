@@ -32,6 +32,7 @@ import (
 	"github.com/nebulasio/go-nebulas/core"
 	"github.com/nebulasio/go-nebulas/net"
 	"github.com/nebulasio/go-nebulas/net/p2p"
+	"github.com/nebulasio/go-nebulas/storage"
 	"github.com/nebulasio/go-nebulas/sync/pb"
 	"github.com/nebulasio/go-nebulas/util/logging"
 	"github.com/sirupsen/logrus"
@@ -40,6 +41,13 @@ import (
 const (
 	chunkDataStatusFinished = int64(-1)
 	chunkDataStatusNotStart = int64(0)
+
+	// chunkDataStatusReceived marks a chunk that has been downloaded,
+	// verified, and staged, but not yet applied to the chain - e.g. the
+	// final chunk, held back pending supermajority irreversible agreement.
+	// Unlike chunkDataStatusNotStart it must not be re-requested, and
+	// unlike chunkDataStatusFinished it must not be counted as done.
+	chunkDataStatusReceived = int64(-2)
 )
 
 var (
@@ -72,12 +80,42 @@ type SyncTask struct {
 	chainChunkDataStatus          map[int]int64
 	chinGetChunkDataDoneCh        chan bool
 
+	// scheduler dispatches distinct chunk indices to distinct peers
+	// concurrently and scores peers so timeouts/bad data trigger a
+	// targeted resend to the next-best peer.
+	scheduler *chunkScheduler
+
+	// store stages verified-but-not-yet-applied chunk data to disk so a
+	// restarted sync resumes instead of starting over from TailBlock().
+	store *ChunkStagingStore
+
+	// rehydratedRootList and rehydratedChunkData are the root list and
+	// chunk data a previous run staged to disk. They are kept separate
+	// from maxConsistentChunkHeaders/chainChunkData, as mere candidates,
+	// until reconcileRehydratedChunkData confirms the fresh consensus
+	// root list still matches - if the chain reorganized while the node
+	// was down, they no longer describe the same chain and are discarded.
+	rehydratedRootList  *syncpb.ChunkHeaders
+	rehydratedChunkData map[int]*syncpb.ChunkData
+
+	// irreversibleHeightVotes tallies, per reported last-irreversible-block
+	// height, how many peers agree on it, so the sync target can be
+	// constrained to min(peer.tail, agreedIrreversibleHeight) instead of the
+	// tail, and the final chunk only applied once a supermajority agrees.
+	irreversibleHeightVotes  map[uint64]int
+	agreedIrreversibleHeight uint64
+
+	// streamingChunkFetch switches sendChainGetChunkMessage over to opening
+	// a ChainChunkDataStream and validating/applying blocks one at a time
+	// via ChunkDataIterator, instead of buffering a whole ChunkData.
+	streamingChunkFetch bool
+
 	// debug fields.
 	chainSyncRetryCount int
 }
 
-func NewSyncTask(blockChain *core.BlockChain, netService p2p.Manager, chunk *Chunk) *SyncTask {
-	return &SyncTask{
+func NewSyncTask(blockChain *core.BlockChain, netService p2p.Manager, chunk *Chunk, db storage.Storage) *SyncTask {
+	st := &SyncTask{
 		quitCh:                            make(chan bool, 1),
 		statusCh:                          make(chan error, 1),
 		blockChain:                        blockChain,
@@ -96,9 +134,110 @@ func NewSyncTask(blockChain *core.BlockChain, netService p2p.Manager, chunk *Chu
 		chainChunkData:                    make(map[int]*syncpb.ChunkData),
 		chainChunkDataStatus:              make(map[int]int64),
 		chinGetChunkDataDoneCh:            make(chan bool, 1),
+		scheduler:                         newChunkScheduler(),
+		irreversibleHeightVotes:           make(map[uint64]int),
 		// debug fields.
 		chainSyncRetryCount: 0,
 	}
+
+	store, err := NewChunkStagingStore(db)
+	if err != nil {
+		logging.VLog().WithFields(logrus.Fields{
+			"err": err,
+		}).Warn("Failed to open chunk staging store, sync will not survive a restart.")
+		return st
+	}
+	st.store = store
+	st.rehydrate()
+
+	return st
+}
+
+// rehydrate loads a previously staged, not-yet-applied sync from disk, as a
+// *candidate* to resume from instead of restarting from
+// blockChain.TailBlock(). It is not trusted outright: the chain may have
+// reorganized while the node was down, so the candidate root list is only
+// merged in by reconcileRehydratedChunkData once a fresh ChunkHeaders vote
+// confirms it still matches the current consensus root.
+func (st *SyncTask) rehydrate() {
+	rootList, err := st.store.GetRootList()
+	if err != nil || rootList == nil || len(rootList.ChunkHeaders) == 0 {
+		return
+	}
+
+	chunkData := make(map[int]*syncpb.ChunkData)
+	for i := 0; i < len(rootList.ChunkHeaders); i++ {
+		data, err := st.store.GetChunkData(i)
+		if err != nil {
+			// not staged - the scheduler fetches distinct chunk indices
+			// from distinct peers concurrently, so staged data on disk
+			// routinely has gaps (e.g. chunk 10 finished and staged while
+			// chunk 3 is still in flight). A gap at one index is not a
+			// reason to drop every later index that was staged.
+			continue
+		}
+		chunkData[i] = data
+	}
+
+	st.rehydratedRootList = rootList
+	st.rehydratedChunkData = chunkData
+
+	logging.VLog().WithFields(logrus.Fields{
+		"stagedChunks":      len(chunkData),
+		"totalChunkHeaders": len(rootList.ChunkHeaders),
+	}).Info("Found staged chunk data from a previous run, pending reconciliation against fresh consensus.")
+}
+
+// reconcileRehydratedChunkData merges rehydrated chunk data into
+// chainChunkData, but only for the indices whose root hash still matches
+// st.maxConsistentChunkHeaders - the root list a fresh ChunkHeaders vote has
+// just agreed on. Entries whose root no longer matches are assumed to
+// belong to a chain that no longer exists (e.g. the chain reorganized while
+// the node was down) and are discarded rather than trusted as already
+// verified for a different chunk.
+//
+// Staged data was, by construction, never applied before the restart (see
+// processChunkData: a chunk is deleted from the store once it has actually
+// been applied), so matching entries are merged in as chunkDataStatusReceived
+// rather than chunkDataStatusFinished, and applyReadyChunks is driven
+// afterwards to actually apply the ones that are ready starting from
+// chainChunkDataProcessPosition - it must not simply be fast-forwarded past
+// them. Must be called with syncMutex held, once hasEnoughChunkHeaders() has
+// become true.
+func (st *SyncTask) reconcileRehydratedChunkData() {
+	if st.rehydratedRootList == nil {
+		return
+	}
+	rootList, chunkData := st.rehydratedRootList, st.rehydratedChunkData
+	st.rehydratedRootList, st.rehydratedChunkData = nil, nil
+
+	reconciled := 0
+	for i, data := range chunkData {
+		if i >= len(rootList.ChunkHeaders) || i >= len(st.maxConsistentChunkHeaders.ChunkHeaders) {
+			continue
+		}
+		staleRoot := rootList.ChunkHeaders[i].Root
+		freshRoot := st.maxConsistentChunkHeaders.ChunkHeaders[i].Root
+		if bytes.Compare(staleRoot, freshRoot) != 0 {
+			logging.VLog().WithFields(logrus.Fields{
+				"chunkIndex": i,
+			}).Warn("Staged chunk data root no longer matches consensus, discarding and re-downloading.")
+			if st.store != nil {
+				st.store.DeleteChunkData(i)
+			}
+			continue
+		}
+		st.chainChunkData[i] = data
+		st.chainChunkDataStatus[i] = chunkDataStatusReceived
+		reconciled++
+	}
+
+	logging.VLog().WithFields(logrus.Fields{
+		"reconciledChunks": reconciled,
+		"discardedChunks":  len(chunkData) - reconciled,
+	}).Info("Reconciled staged chunk data against fresh consensus root list.")
+
+	st.applyReadyChunks("")
 }
 
 func (st *SyncTask) Start() {
@@ -109,6 +248,13 @@ func (st *SyncTask) Stop() {
 	st.quitCh <- true
 }
 
+// EnableStreamingChunkFetch switches chunk-body fetching over to the
+// ChainChunkDataStream/ChunkDataIterator path, so ConcurrentSyncChunkDataCount
+// can be raised on modest hardware without a matching rise in memory use.
+func (st *SyncTask) EnableStreamingChunkFetch() {
+	st.streamingChunkFetch = true
+}
+
 func (st *SyncTask) startSyncLoop() {
 	go func() {
 		for {
@@ -156,6 +302,9 @@ func (st *SyncTask) startSyncLoop() {
 				case <-st.chinGetChunkDataDoneCh:
 					// finished.
 					logging.VLog().Debug("GetChainData Finished.")
+					if st.store != nil {
+						st.store.DeleteRootList()
+					}
 					if len(st.maxConsistentChunkHeaders.ChunkHeaders) == 0 {
 						st.statusCh <- nil
 						return
@@ -183,6 +332,13 @@ func (st *SyncTask) reset() {
 	st.chainChunkDataSyncPosition = 0
 	st.chainChunkDataProcessPosition = 0
 	st.chainChunkData = make(map[int]*syncpb.ChunkData)
+	st.scheduler = newChunkScheduler()
+	st.irreversibleHeightVotes = make(map[uint64]int)
+	st.agreedIrreversibleHeight = 0
+	// rehydratedRootList/rehydratedChunkData are deliberately left alone:
+	// reset() also runs mid-ChainSync on a plain timeout retry (see
+	// startSyncLoop), before processChunkHeaders has had a chance to
+	// reconcile them against a fresh consensus root.
 }
 
 func (st *SyncTask) setSyncPointToNewTail() {
@@ -213,7 +369,8 @@ func (st *SyncTask) sendChainSync() {
 	st.chainSyncRetryCount++
 
 	chunkSync := &syncpb.Sync{
-		TailBlockHash: st.syncPointBlock.Hash(),
+		TailBlockHash:               st.syncPointBlock.Hash(),
+		LastIrreversibleBlockHeight: st.blockChain.LastIrreversibleBlock().Height(),
 	}
 
 	data, err := proto.Marshal(chunkSync)
@@ -231,9 +388,16 @@ func (st *SyncTask) processChunkHeaders(message net.Message) {
 	st.syncMutex.Lock()
 	defer st.syncMutex.Unlock()
 
-	if st.hasEnoughChunkHeaders() {
-		return
-	}
+	// Root-hash consensus (maxConsistentChunkHeaders) is only decided once,
+	// below, and never revisited once hasEnoughChunkHeaders() is true - the
+	// chunk-body fetch pipeline already relies on that root list being
+	// stable. But a message is still worth processing past that point: it
+	// may carry a fresh irreversibleHeightVotes ballot, and
+	// hasSupermajorityIrreversibleAgreement needs those to keep growing past
+	// the much smaller sqrt(peers) root-hash quorum, or its 2/3 bound can
+	// become permanently unreachable if that small quorum doesn't happen to
+	// split 2/3 in agreement.
+	enoughChunkHeaders := st.hasEnoughChunkHeaders()
 
 	// verify the peers.
 	if st.chainSyncPeers == nil {
@@ -293,9 +457,27 @@ func (st *SyncTask) processChunkHeaders(message net.Message) {
 		return
 	}
 
+	st.receivedChunkHeadersRootHashPeers[hashPeerKey] = true
+
+	// Tallied unconditionally - see the enoughChunkHeaders comment above -
+	// so the supermajority gate on the final chunk remains reachable even
+	// after root-hash consensus has settled.
+	irreversibleHeight := chunkHeaders.LastIrreversibleBlockHeight
+	st.irreversibleHeightVotes[irreversibleHeight]++
+	if st.irreversibleHeightVotes[irreversibleHeight] > st.irreversibleHeightVotes[st.agreedIrreversibleHeight] {
+		st.agreedIrreversibleHeight = irreversibleHeight
+	}
+
+	if enoughChunkHeaders {
+		// Root-hash consensus already settled; the new vote above may be
+		// enough to newly satisfy hasSupermajorityIrreversibleAgreement, so
+		// give the final chunk's apply gate another chance.
+		st.applyReadyChunks("")
+		return
+	}
+
 	count := st.chunkHeadersRootHashCounter[rootHash] + 1
 	st.chunkHeadersRootHashCounter[rootHash] = count
-	st.receivedChunkHeadersRootHashPeers[hashPeerKey] = true
 
 	isMax := false
 	if count > st.maxConsistentChunkHeadersCount {
@@ -314,6 +496,14 @@ func (st *SyncTask) processChunkHeaders(message net.Message) {
 	}).Debug("Processed ChainChunkHeaders message data.")
 
 	if st.hasEnoughChunkHeaders() {
+		st.reconcileRehydratedChunkData()
+		if st.store != nil {
+			if err := st.store.PutRootList(st.maxConsistentChunkHeaders); err != nil {
+				logging.VLog().WithFields(logrus.Fields{
+					"err": err,
+				}).Warn("Failed to persist root list to chunk staging store.")
+			}
+		}
 		st.chainSyncDoneCh <- true
 	}
 }
@@ -335,9 +525,11 @@ func (st *SyncTask) sendChainGetChunk() {
 		return
 	}
 
+	ceiling := st.syncCeilingChunkIndex()
+
 	currentSyncChunkDataCount := 0
 	chainChunkDataSyncPosition := 0
-	for i := 0; i < len(st.maxConsistentChunkHeaders.ChunkHeaders) && currentSyncChunkDataCount < ConcurrentSyncChunkDataCount; i++ {
+	for i := 0; i <= ceiling && currentSyncChunkDataCount < ConcurrentSyncChunkDataCount; i++ {
 		if st.chainChunkDataStatus[i] == chunkDataStatusNotStart {
 			currentSyncChunkDataCount++
 			chainChunkDataSyncPosition = i
@@ -348,27 +540,101 @@ func (st *SyncTask) sendChainGetChunk() {
 	st.chainChunkDataSyncPosition = chainChunkDataSyncPosition
 }
 
+// syncCeilingChunkIndex returns the index of the last chunk that may be
+// safely synced: the one whose final block height is <= the agreed
+// last-irreversible-block height, so a syncing node cannot be fed a long but
+// soon-to-be-reorged fork. If no peer has reported an irreversible height
+// (older peers), it falls back to the full chunk list.
+func (st *SyncTask) syncCeilingChunkIndex() int {
+	if st.agreedIrreversibleHeight == 0 {
+		return len(st.maxConsistentChunkHeaders.ChunkHeaders) - 1
+	}
+
+	ceiling := -1
+	for i, chunkHeader := range st.maxConsistentChunkHeaders.ChunkHeaders {
+		if chunkHeader.Height <= st.agreedIrreversibleHeight {
+			ceiling = i
+		}
+	}
+	return ceiling
+}
+
+// chunkPassesIrreversibleGate reports whether chunkIndex may be applied now:
+// true unless chunkIndex is the irreversible-block sync ceiling and no
+// supermajority of respondents has yet agreed on the irreversible height, in
+// which case applying it would risk feeding a node a soon-to-be-reorged
+// fork's tail chunk. Shared by the buffered path (applyReadyChunks) and the
+// streaming path (waitForChunkTurn), which would otherwise bypass this gate
+// entirely by applying blocks directly as they arrive.
+func (st *SyncTask) chunkPassesIrreversibleGate(chunkIndex int) bool {
+	if chunkIndex != st.syncCeilingChunkIndex() {
+		return true
+	}
+	return st.hasSupermajorityIrreversibleAgreement()
+}
+
+// hasSupermajorityIrreversibleAgreement reports whether at least 2/3 of the
+// peers that actually responded with ChunkHeaders agree on the currently
+// agreed irreversible height. The denominator is
+// len(receivedChunkHeadersRootHashPeers), not len(chainSyncPeers): most of
+// the peers a ChainSync request went out to never reply, and counting them
+// against the supermajority would make it unreachable in practice.
+// receivedChunkHeadersRootHashPeers (unlike chunkHeadersRootHashCounter) is
+// still recorded for every respondent even after root-hash consensus has
+// settled, so this denominator - and the numerator it's compared against -
+// keep growing as further respondents are heard from, instead of both
+// freezing at the much smaller sqrt(peers) root-hash quorum.
+func (st *SyncTask) hasSupermajorityIrreversibleAgreement() bool {
+	total := len(st.receivedChunkHeadersRootHashPeers)
+	if total == 0 {
+		return false
+	}
+	return st.irreversibleHeightVotes[st.agreedIrreversibleHeight]*3 >= total*2
+}
+
 func (st *SyncTask) checkChainGetChunkTimeout() {
 	// lock.
 	st.syncMutex.Lock()
 	defer st.syncMutex.Unlock()
 
+	// a chunk already downloaded may have been held back only because no
+	// supermajority had agreed on the irreversible height yet; re-check
+	// that now rather than waiting for another chunk to arrive and
+	// trigger it incidentally.
+	if st.chainChunkDataStatus[st.chainChunkDataProcessPosition] == chunkDataStatusReceived {
+		st.applyReadyChunks("")
+	}
+
 	timeoutAtThreshold := time.Now().Unix() - GetChunkDataTimeout
 
 	for i := 0; i < st.chainChunkDataSyncPosition; i++ {
 		t := st.chainChunkDataStatus[i]
-		if t == chunkDataStatusFinished || t == chunkDataStatusNotStart {
+		if t == chunkDataStatusFinished || t == chunkDataStatusNotStart || t == chunkDataStatusReceived {
 			continue
 		}
 
 		if t <= timeoutAtThreshold {
-			// timeout, send again.
-			st.sendChainGetChunkMessage(i)
+			// timeout, penalize the peer that was servicing this chunk and
+			// hand it to the next-best candidate.
+			failedPeer := st.scheduler.reassign(i)
+			excludePeers := map[string]bool{}
+			if failedPeer != "" {
+				st.scheduler.recordFailure(failedPeer)
+				excludePeers[failedPeer] = true
+			}
+			st.sendChainGetChunkMessageExcluding(i, excludePeers)
 		}
 	}
 }
 
 func (st *SyncTask) sendChainGetChunkMessage(chunkHeaderIndex int) {
+	st.sendChainGetChunkMessageExcluding(chunkHeaderIndex, nil)
+}
+
+// sendChainGetChunkMessageExcluding dispatches the chunk request to the
+// scheduler's best-scoring candidate peer, excluding excludePeers (used when
+// retrying a chunk that a given peer has just failed to serve).
+func (st *SyncTask) sendChainGetChunkMessageExcluding(chunkHeaderIndex int, excludePeers map[string]bool) {
 	chunkHeader := st.maxConsistentChunkHeaders.ChunkHeaders[chunkHeaderIndex]
 	data, err := proto.Marshal(chunkHeader)
 	if err != nil {
@@ -377,7 +643,23 @@ func (st *SyncTask) sendChainGetChunkMessage(chunkHeaderIndex int) {
 		}).Warn("Failed to marshal ChunkHeader.")
 		return
 	}
-	st.netService.SendMessageToPeers(net.ChainGetChunk, data, net.MessagePriorityLow, new(p2p.RandomPeerFilter))
+
+	peer := st.scheduler.pickPeer(st.chainSyncPeers, excludePeers)
+	if peer == "" {
+		// no under-budget, non-blacklisted candidate right now; fall back
+		// to a random broadcast so the chunk is still retried.
+		st.netService.SendMessageToPeers(net.ChainGetChunk, data, net.MessagePriorityLow, new(p2p.RandomPeerFilter))
+		st.chainChunkDataStatus[chunkHeaderIndex] = time.Now().Unix()
+		return
+	}
+
+	if st.streamingChunkFetch {
+		st.sendChainGetChunkMessageStream(chunkHeaderIndex, peer)
+		return
+	}
+
+	st.netService.SendMessageToPeer(net.ChainGetChunk, data, net.MessagePriorityLow, peer)
+	st.scheduler.assign(chunkHeaderIndex, peer)
 	st.chainChunkDataStatus[chunkHeaderIndex] = time.Now().Unix()
 }
 
@@ -423,43 +705,103 @@ func (st *SyncTask) processChunkData(message net.Message) {
 		return
 	}
 
+	dispatchedAt := st.chainChunkDataStatus[chunkDataIndex]
+
 	if ok, err := VerifyChunkData(chunkHeader, chunkData); ok == false {
 		logging.VLog().WithFields(logrus.Fields{
 			"err": err,
 			"pid": message.MessageFrom(),
 		}).Debug("Wrong ChainChunkData message data, retry.")
 		st.netService.ClosePeer(message.MessageFrom(), err)
-		st.sendChainGetChunkMessage(chunkDataIndex)
+		failedPeer := st.scheduler.reassign(chunkDataIndex)
+		st.scheduler.recordFailure(message.MessageFrom())
+		excludePeers := map[string]bool{message.MessageFrom(): true}
+		if failedPeer != "" {
+			excludePeers[failedPeer] = true
+		}
+		st.sendChainGetChunkMessageExcluding(chunkDataIndex, excludePeers)
 		return
 	}
 
+	st.scheduler.recordSuccess(message.MessageFrom(), time.Duration(time.Now().Unix()-dispatchedAt)*time.Second, len(message.Data().([]byte)))
+	st.scheduler.release(chunkDataIndex)
+
 	st.chainChunkData[chunkDataIndex] = chunkData
+	if st.store != nil {
+		if err := st.store.PutChunkData(chunkDataIndex, chunkData); err != nil {
+			logging.VLog().WithFields(logrus.Fields{
+				"err": err,
+			}).Warn("Failed to stage chunk data to disk.")
+		}
+	}
+
+	if err := st.applyReadyChunks(message.MessageFrom()); err != nil {
+		return
+	}
+
+	// chunkDataIndex may not have been applied above - either it is
+	// buffered ahead of chainChunkDataProcessPosition waiting on earlier
+	// chunks, or it is the final chunk held back pending supermajority
+	// irreversible agreement. Only mark it Finished once it is actually
+	// applied; otherwise a later check could see every status as
+	// "finished" while the final chunk's blocks were never applied, and
+	// declare the sync round done prematurely.
+	if chunkDataIndex >= st.chainChunkDataProcessPosition {
+		st.chainChunkDataStatus[chunkDataIndex] = chunkDataStatusReceived
+	}
+
+	// sync next chunk.
+	logging.VLog().Debugf("Succeed to get chain chunk %d.", chunkDataIndex)
+	st.sendChainGetChunkForNext()
+}
+
+// applyReadyChunks applies buffered chunk data that is contiguous from
+// chainChunkDataProcessPosition, stopping at the irreversible-block ceiling
+// until a supermajority of respondents agree on the irreversible height at
+// that point. Callers must hold syncMutex. sourcePeer is used only to
+// attribute an application failure for ClosePeer/retry purposes, and may be
+// empty when applyReadyChunks is re-driven by a timer rather than a
+// specific incoming message.
+func (st *SyncTask) applyReadyChunks(sourcePeer string) error {
 	chunk, ok := st.chainChunkData[st.chainChunkDataProcessPosition]
 	for ok {
+		processPosition := st.chainChunkDataProcessPosition
+		if !st.chunkPassesIrreversibleGate(processPosition) {
+			// the final chunk is only applied once a supermajority of
+			// respondents agree on the irreversible header at this
+			// height, so a node cannot be fed a soon-to-be-reorged fork.
+			logging.VLog().WithFields(logrus.Fields{
+				"agreedIrreversibleHeight": st.agreedIrreversibleHeight,
+				"votes":                    st.irreversibleHeightVotes[st.agreedIrreversibleHeight],
+			}).Debug("Waiting for supermajority agreement on irreversible height before applying final chunk.")
+			break
+		}
 		if err := st.chunk.processChunkData(chunk); err != nil {
 			logging.VLog().WithFields(logrus.Fields{
 				"err": err,
-				"pid": message.MessageFrom(),
+				"pid": sourcePeer,
 			}).Debug("Wrong ChainChunkData message data, retry.")
-			st.netService.ClosePeer(message.MessageFrom(), err)
-			st.sendChainGetChunkMessage(chunkDataIndex)
-			return
+			if sourcePeer != "" {
+				st.netService.ClosePeer(sourcePeer, err)
+			}
+			st.sendChainGetChunkMessage(processPosition)
+			return err
+		}
+		if st.store != nil {
+			// applied; stop staging it and compact the disk footprint.
+			st.store.DeleteChunkData(processPosition)
 		}
+		st.chainChunkDataStatus[processPosition] = chunkDataStatusFinished
 		st.chainChunkDataProcessPosition++
 		chunk, ok = st.chainChunkData[st.chainChunkDataProcessPosition]
 	}
 
-	// mark done.
-	st.chainChunkDataStatus[chunkDataIndex] = chunkDataStatusFinished
-
-	// sync next chunk.
-	logging.VLog().Debugf("Succeed to get chain chunk %d.")
-	st.sendChainGetChunkForNext()
+	return nil
 }
 
 func (st *SyncTask) sendChainGetChunkForNext() {
 	nextPos := st.chainChunkDataSyncPosition + 1
-	if nextPos >= len(st.maxConsistentChunkHeaders.ChunkHeaders) {
+	if nextPos > st.syncCeilingChunkIndex() {
 		if st.hasFinishedGetAllChunkData() {
 			st.chinGetChunkDataDoneCh <- true
 		}
@@ -491,7 +833,10 @@ func (st *SyncTask) hasEnoughChunkHeaders() bool {
 }
 
 func (st *SyncTask) hasFinishedGetAllChunkData() bool {
-	total := len(st.maxConsistentChunkHeaders.ChunkHeaders)
+	// chunks beyond the irreversible-block ceiling are never requested, so
+	// only the chunks up to the ceiling (and not the rest of
+	// maxConsistentChunkHeaders) count towards "total".
+	total := st.syncCeilingChunkIndex() + 1
 	missing := 0
 	for i := 0; i < total; i++ {
 		if st.chainChunkDataStatus[i] != chunkDataStatusFinished {
@@ -0,0 +1,161 @@
+// Copyright (C) 2018 go-nebulas authors
+//
+// This file is part of the go-nebulas library.
+//
+// the go-nebulas library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// the go-nebulas library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with the go-nebulas library.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package sync
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nebulasio/go-nebulas/sync/pb"
+)
+
+func TestHasSupermajorityIrreversibleAgreementCountsRespondentsNotRequestedPeers(t *testing.T) {
+	st := &SyncTask{
+		// 10 peers were asked, but only 3 ever replied.
+		chainSyncPeers:                    []string{"p1", "p2", "p3", "p4", "p5", "p6", "p7", "p8", "p9", "p10"},
+		receivedChunkHeadersRootHashPeers: map[string]bool{"root-p1": true, "root-p2": true, "root-p3": true},
+		irreversibleHeightVotes:           map[uint64]int{100: 3},
+		agreedIrreversibleHeight:          100,
+	}
+
+	if !st.hasSupermajorityIrreversibleAgreement() {
+		t.Fatalf("expected supermajority agreement among 3/3 respondents, regardless of the 10 requested peers")
+	}
+}
+
+func TestHasSupermajorityIrreversibleAgreementRequiresTwoThirdsOfRespondents(t *testing.T) {
+	st := &SyncTask{
+		receivedChunkHeadersRootHashPeers: map[string]bool{"root-a-p1": true, "root-a-p2": true, "root-b-p3": true},
+		irreversibleHeightVotes:           map[uint64]int{100: 1},
+		agreedIrreversibleHeight:          100,
+	}
+
+	if st.hasSupermajorityIrreversibleAgreement() {
+		t.Fatalf("1 of 3 respondents agreeing should not satisfy the 2/3 supermajority bound")
+	}
+}
+
+func TestHasSupermajorityIrreversibleAgreementKeepsGrowingPastRootHashQuorum(t *testing.T) {
+	// A root-hash quorum of 2 was reached (and frozen in
+	// maxConsistentChunkHeaders/chunkHeadersRootHashCounter) after only 2
+	// respondents, but 2 more have since replied without changing the root
+	// consensus. The supermajority gate must still see all 4 respondents,
+	// not just the 2 that decided the root.
+	st := &SyncTask{
+		chunkHeadersRootHashCounter: map[string]int{"root-a": 2},
+		receivedChunkHeadersRootHashPeers: map[string]bool{
+			"root-a-p1": true, "root-a-p2": true, "root-a-p3": true, "root-a-p4": true,
+		},
+		irreversibleHeightVotes:  map[uint64]int{100: 3},
+		agreedIrreversibleHeight: 100,
+	}
+
+	if !st.hasSupermajorityIrreversibleAgreement() {
+		t.Fatalf("expected 3/4 respondents agreeing to satisfy the 2/3 supermajority bound even though only 2 of them decided the root-hash quorum")
+	}
+}
+
+func TestApplyReadyChunksHoldsFinalChunkUntilSupermajority(t *testing.T) {
+	st := &SyncTask{
+		chainChunkData:                map[int]*syncpb.ChunkData{0: {}},
+		chainChunkDataStatus:          map[int]int64{0: time.Now().Unix()},
+		chainChunkDataProcessPosition: 0,
+		maxConsistentChunkHeaders:     &syncpb.ChunkHeaders{ChunkHeaders: []*syncpb.ChunkHeader{{Height: 1}}},
+		receivedChunkHeadersRootHashPeers: map[string]bool{
+			"root-a-p1": true, "root-b-p2": true, "root-b-p3": true,
+		},
+		irreversibleHeightVotes: map[uint64]int{0: 1},
+	}
+
+	if err := st.applyReadyChunks(""); err != nil {
+		t.Fatalf("applyReadyChunks() error = %v", err)
+	}
+
+	if st.chainChunkDataProcessPosition != 0 {
+		t.Fatalf("chainChunkDataProcessPosition advanced to %d without supermajority agreement on the final chunk", st.chainChunkDataProcessPosition)
+	}
+
+	// The caller (processChunkData) is responsible for leaving the status
+	// as chunkDataStatusReceived rather than chunkDataStatusFinished when
+	// applyReadyChunks declines to apply it - verify the chunk truly
+	// wasn't applied, so hasFinishedGetAllChunkData can't be fooled.
+	if st.chainChunkDataStatus[0] == chunkDataStatusFinished {
+		t.Fatalf("status must not be Finished for a chunk applyReadyChunks declined to apply")
+	}
+}
+
+func TestReconcileRehydratedChunkDataKeepsMatchingRoot(t *testing.T) {
+	root := []byte("root-0")
+	st := &SyncTask{
+		chainChunkData:       make(map[int]*syncpb.ChunkData),
+		chainChunkDataStatus: make(map[int]int64),
+		rehydratedRootList:   &syncpb.ChunkHeaders{ChunkHeaders: []*syncpb.ChunkHeader{{Root: root, Height: 1}}},
+		rehydratedChunkData:  map[int]*syncpb.ChunkData{0: {Root: root}},
+		maxConsistentChunkHeaders: &syncpb.ChunkHeaders{
+			ChunkHeaders: []*syncpb.ChunkHeader{{Root: root, Height: 1}},
+		},
+		// deliberately not a supermajority, so applyReadyChunks's gate on
+		// the lone (and therefore final) chunk stops it before it would
+		// reach into the nil chunk field.
+		receivedChunkHeadersRootHashPeers: map[string]bool{
+			"root-a-p1": true, "root-b-p2": true, "root-b-p3": true,
+		},
+		irreversibleHeightVotes: map[uint64]int{0: 1},
+	}
+
+	st.reconcileRehydratedChunkData()
+
+	if st.rehydratedRootList != nil || st.rehydratedChunkData != nil {
+		t.Fatalf("reconcileRehydratedChunkData() must clear the rehydrated candidate once reconciled")
+	}
+	if _, ok := st.chainChunkData[0]; !ok {
+		t.Fatalf("staged chunk data whose root still matches consensus must be merged into chainChunkData")
+	}
+	if st.chainChunkDataStatus[0] != chunkDataStatusReceived {
+		t.Fatalf("chainChunkDataStatus[0] = %d, want chunkDataStatusReceived (%d): reconcile must not claim staged-but-unapplied data is Finished", st.chainChunkDataStatus[0], chunkDataStatusReceived)
+	}
+	if st.chainChunkDataProcessPosition != 0 {
+		t.Fatalf("chainChunkDataProcessPosition = %d, want 0: reconcile must not fast-forward past data it never actually applied", st.chainChunkDataProcessPosition)
+	}
+}
+
+func TestReconcileRehydratedChunkDataDiscardsMismatchedRoot(t *testing.T) {
+	st := &SyncTask{
+		chainChunkData:       make(map[int]*syncpb.ChunkData),
+		chainChunkDataStatus: make(map[int]int64),
+		rehydratedRootList:   &syncpb.ChunkHeaders{ChunkHeaders: []*syncpb.ChunkHeader{{Root: []byte("stale-root"), Height: 1}}},
+		rehydratedChunkData:  map[int]*syncpb.ChunkData{0: {Root: []byte("stale-root")}},
+		maxConsistentChunkHeaders: &syncpb.ChunkHeaders{
+			// the chain reorganized while the node was down: a fresh
+			// consensus vote now disagrees with the staged root.
+			ChunkHeaders: []*syncpb.ChunkHeader{{Root: []byte("fresh-root"), Height: 1}},
+		},
+		chunkHeadersRootHashCounter: map[string]int{"fresh-root": 1},
+		irreversibleHeightVotes:     map[uint64]int{0: 1},
+	}
+
+	st.reconcileRehydratedChunkData()
+
+	if _, ok := st.chainChunkData[0]; ok {
+		t.Fatalf("staged chunk data whose root no longer matches consensus must not be merged in")
+	}
+	if st.chainChunkDataProcessPosition != 0 {
+		t.Fatalf("chainChunkDataProcessPosition = %d, want 0 after discarding a mismatched chunk", st.chainChunkDataProcessPosition)
+	}
+}